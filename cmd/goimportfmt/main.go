@@ -1,21 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 
+	"github.com/pkg/diff"
+
 	"github.com/morikuni/goimportfmt"
 )
 
+var generatedFileRE = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
 func main() {
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	write := fs.Bool("w", false, "write result to source file.")
+	list := fs.Bool("l", false, "list files whose formatting differs (combine with -w to also write them).")
+	showDiff := fs.Bool("d", false, "print a unified diff of each changed file (combine with -w to also write them).")
+	recursive := fs.Bool("r", false, "recurse into subdirectories.")
+	local := fs.String("local", "", "comma-separated list of package prefixes to group with the current module.")
+	company := fs.String("company", "", "comma-separated list of package prefixes to group between third-party and local imports.")
+	srcdir := fs.String("srcdir", "", "directory to use for module resolution when formatting stdin.")
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [flags] filename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] path ...\n", os.Args[0])
 		fs.PrintDefaults()
 	}
 
@@ -24,50 +39,264 @@ func main() {
 		panic(err)
 	}
 
-	filename := fs.Arg(0)
-	src, err := os.Open(filename)
+	opts := []goimportfmt.Option{
+		goimportfmt.WithLocalPrefixes(*local),
+		goimportfmt.WithCompanyPrefixes(*company),
+	}
+
+	paths := fs.Args()
+	if len(paths) == 1 && paths[0] == "-" {
+		if err := processStdin(*srcdir, opts); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := collectFiles(paths, *recursive)
 	if err != nil {
 		panic(err)
 	}
-	var once sync.Once
-	close := func() {
-		once.Do(func() {
-			src.Close()
-		})
+
+	r := &runner{
+		write:   *write,
+		list:    *list,
+		diff:    *showDiff,
+		opts:    opts,
+		ctx:     &goimportfmt.Context{},
+		modules: make(map[string]string),
+	}
+
+	changed, failed := r.run(files)
+	if failed {
+		os.Exit(1)
+	}
+	if (*list || *showDiff) && changed {
+		os.Exit(1)
 	}
-	defer close()
+}
 
-	p, err := goimportfmt.DetectModulePath(filename)
+// processStdin formats the "-" filename by reading from stdin and writing
+// to stdout, the convention editor integrations rely on. Since
+// DetectModulePath needs a real file to stat, srcdir lets the caller say
+// which module the stdin buffer belongs to, mirroring goimports' -srcdir.
+func processStdin(srcdir string, opts []goimportfmt.Option) error {
+	src, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	stat, err := src.Stat()
+	var p string
+	if srcdir != "" {
+		p, err = goimportfmt.DetectModulePathDir(srcdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts = append([]goimportfmt.Option{goimportfmt.WithModulePath(p)}, opts...)
+	return goimportfmt.Process(bytes.NewReader(src), os.Stdout, opts...)
+}
+
+// runner formats a batch of files concurrently, sharing a single
+// DetectModulePath result per directory so packages.Load isn't re-run for
+// every file in the same package, and a single goimportfmt.Context across
+// every file so its stdlib/import-name/sibling caches are reused too.
+type runner struct {
+	write bool
+	list  bool
+	diff  bool
+	opts  []goimportfmt.Option
+	ctx   *goimportfmt.Context
+
+	mu      sync.Mutex
+	modules map[string]string
+}
+
+func (r *runner) run(files []string) (changed, failed bool) {
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, file := range files {
+		file := file
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fileChanged, err := r.process(file)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+				failed = true
+				return
+			}
+			if fileChanged {
+				changed = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	return changed, failed
+}
+
+func (r *runner) modulePath(file string) (string, error) {
+	dir := filepath.Dir(file)
+
+	r.mu.Lock()
+	p, ok := r.modules[dir]
+	r.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	p, err := goimportfmt.DetectModulePath(file)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, int(stat.Size())))
-	err = goimportfmt.Process(src, buf, goimportfmt.WithModulePath(p))
+	r.mu.Lock()
+	r.modules[dir] = p
+	r.mu.Unlock()
+
+	return p, nil
+}
+
+func (r *runner) process(file string) (bool, error) {
+	p, err := r.modulePath(file)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
-	if *write {
-		close()
-		f, err := os.Create(filename)
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	opts := append([]goimportfmt.Option{goimportfmt.WithModulePath(p), goimportfmt.WithContext(r.ctx)}, r.opts...)
+	var buf bytes.Buffer
+	if err := goimportfmt.Process(bytes.NewReader(src), &buf, opts...); err != nil {
+		return false, err
+	}
+
+	if bytes.Equal(src, buf.Bytes()) {
+		return false, nil
+	}
+
+	// -l, -d and -w are independent, as in gofmt/goimports: e.g. -l -w lists
+	// a changed file and writes it. Only when none of them are set does the
+	// result go to stdout instead.
+	if r.list {
+		fmt.Println(file)
+	}
+	if r.diff {
+		if err := diff.Text(file+".orig", file, src, buf.Bytes(), os.Stdout); err != nil {
+			return false, err
+		}
+	}
+	if r.write {
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			return false, err
+		}
+	}
+	if !r.list && !r.diff && !r.write {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// collectFiles expands paths into a flat list of .go files, walking
+// directories (recursively when recursive is set) and skipping vendor/,
+// testdata/, dotdirs and generated files.
+func collectFiles(paths []string, recursive bool) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
 		}
 
-		_, err = io.Copy(f, buf)
+		found, err := walkDir(p, recursive)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-	} else {
-		_, err = io.Copy(os.Stdout, buf)
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+func walkDir(dir string, recursive bool) ([]string, error) {
+	var files []string
+
+	var walk func(string) error
+	walk = func(dir string) error {
+		entries, err := ioutil.ReadDir(dir)
 		if err != nil {
-			panic(err)
+			return err
+		}
+
+		for _, e := range entries {
+			name := e.Name()
+			full := filepath.Join(dir, name)
+
+			if e.IsDir() {
+				if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") {
+					continue
+				}
+				if recursive {
+					if err := walk(full); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if !strings.HasSuffix(name, ".go") {
+				continue
+			}
+
+			generated, err := isGeneratedFile(full)
+			if err != nil {
+				return err
+			}
+			if generated {
+				continue
+			}
+
+			files = append(files, full)
+		}
+		return nil
+	}
+
+	return files, walk(dir)
+}
+
+func isGeneratedFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if generatedFileRE.MatchString(sc.Text()) {
+			return true, nil
 		}
 	}
+	return false, sc.Err()
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/morikuni/goimportfmt"
+)
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestWalkDirSkipsVendorTestdataDotdirsAndGenerated(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "keep.go"), "package foo\n")
+	mustWriteFile(t, filepath.Join(dir, "vendor", "dep.go"), "package dep\n")
+	mustWriteFile(t, filepath.Join(dir, "testdata", "fixture.go"), "package fixture\n")
+	mustWriteFile(t, filepath.Join(dir, ".hidden", "x.go"), "package hidden\n")
+	mustWriteFile(t, filepath.Join(dir, "generated.go"), "// Code generated by somegen. DO NOT EDIT.\n\npackage foo\n")
+	mustWriteFile(t, filepath.Join(dir, "sub", "nested.go"), "package sub\n")
+
+	files, err := walkDir(dir, true)
+	if err != nil {
+		t.Fatalf("walkDir: %v", err)
+	}
+
+	want := map[string]bool{
+		filepath.Join(dir, "keep.go"):          true,
+		filepath.Join(dir, "sub", "nested.go"): true,
+	}
+	got := make(map[string]bool, len(files))
+	for _, f := range files {
+		got[f] = true
+	}
+	if len(got) != len(want) {
+		t.Fatalf("walkDir(%q, true) = %v, want exactly %v", dir, files, want)
+	}
+	for f := range want {
+		if !got[f] {
+			t.Errorf("expected %q to be included, got %v", f, files)
+		}
+	}
+}
+
+func TestWalkDirNonRecursiveSkipsSubdirs(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "keep.go"), "package foo\n")
+	mustWriteFile(t, filepath.Join(dir, "sub", "nested.go"), "package sub\n")
+
+	files, err := walkDir(dir, false)
+	if err != nil {
+		t.Fatalf("walkDir: %v", err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(dir, "keep.go") {
+		t.Fatalf("walkDir(%q, false) = %v, want only keep.go", dir, files)
+	}
+}
+
+func TestIsGeneratedFile(t *testing.T) {
+	dir := t.TempDir()
+
+	gen := filepath.Join(dir, "gen.go")
+	mustWriteFile(t, gen, "// Code generated by somegen. DO NOT EDIT.\n\npackage foo\n")
+
+	plain := filepath.Join(dir, "plain.go")
+	mustWriteFile(t, plain, "package foo\n")
+
+	got, err := isGeneratedFile(gen)
+	if err != nil {
+		t.Fatalf("isGeneratedFile(gen): %v", err)
+	}
+	if !got {
+		t.Error("expected generated file to be detected")
+	}
+
+	got, err = isGeneratedFile(plain)
+	if err != nil {
+		t.Fatalf("isGeneratedFile(plain): %v", err)
+	}
+	if got {
+		t.Error("expected plain file not to be detected as generated")
+	}
+}
+
+func TestRunnerProcessCombinesListAndWrite(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.go")
+	src := "package foo\n\nimport (\n\t\"github.com/foo/bar\"\n\t\"fmt\"\n)\n\nfunc F() { fmt.Println(bar.X) }\n"
+	mustWriteFile(t, file, src)
+
+	r := &runner{
+		write:   true,
+		list:    true,
+		ctx:     &goimportfmt.Context{},
+		modules: make(map[string]string),
+	}
+
+	changed, err := r.process(file)
+	if err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read back file: %v", err)
+	}
+	if string(got) == src {
+		t.Fatal("-w should have rewritten the file on disk even though -l was also set")
+	}
+}
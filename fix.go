@@ -0,0 +1,254 @@
+package goimportfmt
+
+import (
+	"go/ast"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// usedIdents returns the set of identifiers referenced as the X of a
+// selector expression (pkg.Ident) anywhere in f that the parser couldn't
+// resolve to anything declared in f itself (f.Unresolved) - the same set
+// goimports treats as candidate package references. Checking f.Unresolved
+// rather than every SelectorExpr.X matters: without it, a local variable,
+// parameter or receiver whose name happens to match a package reachable
+// from the module (e.g. a "log" variable next to a resolvable "log"
+// package) would be misread as a package reference and fixed into a
+// spurious, compile-breaking import.
+func usedIdents(f *ast.File) map[string]bool {
+	unresolved := make(map[string]bool, len(f.Unresolved))
+	for _, id := range f.Unresolved {
+		unresolved[id.Name] = true
+	}
+
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && unresolved[id.Name] {
+			used[id.Name] = true
+		}
+		return true
+	})
+	return used
+}
+
+// semverPathSuffixRE matches a semantic-import-versioning suffix such as
+// "v2" or "v8" as the last path element, e.g. in
+// "github.com/go-redis/redis/v8".
+var semverPathSuffixRE = regexp.MustCompile(`^v[0-9]+$`)
+
+// guessImportName approximates the identifier an import is referred to by
+// in code from its path alone, for use when the package can't be loaded to
+// find its actual declared name. It strips a semantic-import-versioning
+// suffix ("v2", "v8", ...), since Go itself ignores those when deriving the
+// default package name.
+func guessImportName(path string) string {
+	base := filepath.Base(path)
+	if semverPathSuffixRE.MatchString(base) {
+		if dir := filepath.Dir(path); dir != "." {
+			return filepath.Base(dir)
+		}
+	}
+	return base
+}
+
+// importNameResolver resolves the identifier an import is referred to by in
+// code, preferring the package's actual declared name (as reported by
+// packages.Load) over guessImportName's path-based approximation, since
+// semantic-import-versioned and otherwise renamed packages don't follow it.
+// Results are cached on ctx per path, since resolving the same import
+// repeatedly across a fix pass - or across the many files of a batch run
+// sharing ctx via WithContext - would otherwise reload the same package
+// many times.
+type importNameResolver struct {
+	dir string
+	ctx *Context
+}
+
+// newImportNameResolver returns an importNameResolver that loads packages
+// from dir. dir is empty when the caller didn't configure WithSourceDir, in
+// which case nameOf falls back to guessImportName for every import.
+func newImportNameResolver(dir string, ctx *Context) *importNameResolver {
+	return &importNameResolver{dir: dir, ctx: ctx}
+}
+
+// nameOf returns the identifier i is referred to by in code.
+func (r *importNameResolver) nameOf(i *Import) string {
+	if i.Name != "" {
+		return i.Name
+	}
+
+	cache := r.ctx.ensureCache()
+	if name, ok := cache.cachedName(i.Path); ok {
+		return name
+	}
+
+	name := guessImportName(i.Path)
+	if r.dir != "" {
+		cfg := &packages.Config{Dir: r.dir, Mode: packages.NeedName}
+		if pkgs, err := packages.Load(cfg, i.Path); err == nil && len(pkgs) == 1 && pkgs[0].Name != "" {
+			name = pkgs[0].Name
+		}
+	}
+
+	cache.cacheName(i.Path, name)
+	return name
+}
+
+// hasSideEffectMarker reports whether an import is documented as being kept
+// for its side effects, e.g. a //go:linkname directive, even though nothing
+// in the file references it by name.
+func hasSideEffectMarker(i *Import) bool {
+	for _, d := range i.Docs {
+		if strings.Contains(d, "go:linkname") {
+			return true
+		}
+	}
+	return false
+}
+
+// dropUnusedImports removes imports that nothing in the file references.
+// Blank (_) and dot (.) imports are always kept, since their effect can't be
+// observed from identifier usage.
+func dropUnusedImports(is []*Import, used map[string]bool, names *importNameResolver) []*Import {
+	kept := is[:0:0]
+	for _, i := range is {
+		name := names.nameOf(i)
+		if name == "_" || name == "." || hasSideEffectMarker(i) || used[name] {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+// missingIdents returns identifiers used as a selector base in the file but
+// not satisfied by any of the already-declared imports, sorted for
+// deterministic output.
+func missingIdents(used map[string]bool, is []*Import, names *importNameResolver) []string {
+	have := make(map[string]bool, len(is))
+	for _, i := range is {
+		have[names.nameOf(i)] = true
+	}
+
+	var missing []string
+	for name := range used {
+		if !have[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// resolveImports turns unresolved identifiers into candidate imports by
+// loading the packages visible from dir (the current module, GOPATH and
+// module cache). dir is empty when the caller didn't configure
+// WithSourceDir, in which case resolution is skipped and only the
+// drop-unused half of the fix pass applies.
+func resolveImports(dir string, idents []string, ctx *Context) ([]*Import, error) {
+	if dir == "" || len(idents) == 0 {
+		return nil, nil
+	}
+
+	sibling, err := siblingImports(dir, ctx)
+	if err != nil {
+		sibling = nil
+	}
+
+	cfg := &packages.Config{
+		Dir:  dir,
+		Mode: packages.NeedName,
+	}
+	pkgs, err := packages.Load(cfg, "all")
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string][]*packages.Package)
+	for _, p := range pkgs {
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	var resolved []*Import
+	for _, name := range idents {
+		cands := byName[name]
+		if len(cands) == 0 {
+			continue
+		}
+		sort.Slice(cands, func(i, j int) bool {
+			ri, rj := importRank(cands[i].PkgPath, ctx, sibling), importRank(cands[j].PkgPath, ctx, sibling)
+			if ri != rj {
+				return ri < rj
+			}
+			return cands[i].PkgPath < cands[j].PkgPath
+		})
+		resolved = append(resolved, &Import{Path: cands[0].PkgPath})
+	}
+
+	return resolved, nil
+}
+
+// importRank orders candidate packages the way a human resolving an unknown
+// identifier would: standard library first, then the current module, then
+// packages a sibling file in the same directory already imports.
+func importRank(path string, ctx *Context, sibling map[string]bool) int {
+	if ctx != nil && ctx.IsStdlib(path) {
+		return 0
+	}
+	if ctx != nil && ctx.ModulePath != "" && matchesPrefix(path, ctx.ModulePath) {
+		return 1
+	}
+	if sibling[path] {
+		return 2
+	}
+	return 3
+}
+
+// siblingImports scans the .go files in dir and returns the set of import
+// paths they already use, so resolveImports can prefer packages the
+// package already depends on over unrelated ones with the same name. The
+// scan runs once per dir and is cached on ctx, since a batch run sharing
+// ctx via WithContext would otherwise re-read and re-parse every sibling
+// file for every file it formats in that directory.
+func siblingImports(dir string, ctx *Context) (map[string]bool, error) {
+	var cache *contextCache
+	if ctx != nil {
+		cache = ctx.ensureCache()
+		if set, ok := cache.cachedSiblings(dir); ok {
+			return set, nil
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") || strings.HasSuffix(e.Name(), "_test.go") {
+			continue
+		}
+
+		is, err := loadImportsFromFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		for _, i := range is {
+			seen[i.Path] = true
+		}
+	}
+
+	if cache != nil {
+		cache.cacheSiblings(dir, seen)
+	}
+	return seen, nil
+}
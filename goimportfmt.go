@@ -9,11 +9,14 @@ import (
 	"go/parser"
 	"go/token"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -29,103 +32,147 @@ func Process(src io.Reader, dst io.Writer, opts ...Option) error {
 	if err != nil {
 		return fmt.Errorf("failed to remove imports: %w", err)
 	}
+	cgo, is := extractCgoImport(is)
 
-	fl, err := removeImports(fs, f)
+	insertPos, err := removeImports(f)
 	if err != nil {
 		return fmt.Errorf("failed to remove imports: %w", err)
 	}
 
 	conf := newConfig(opts)
 
-	ctx := &Context{
-		ModulePath: conf.modulePath,
+	// Process always works with a Context value of its own: conf.ctx may be
+	// shared across concurrent calls via WithContext, and mutating its
+	// ModulePath/LocalPrefixes/CompanyPrefixes in place would race with
+	// another goroutine's call for a different file. The cache behind it is
+	// what's actually safe, and worth, sharing, so that's what's reused.
+	var cache *contextCache
+	if conf.ctx != nil {
+		cache = conf.ctx.ensureCache()
+	} else {
+		cache = &contextCache{}
 	}
-	w := &importInsertWriter{
-		dst,
-		fl,
-		0,
-		nil,
-		conf.formatFunc(ctx, is),
+	ctx := &Context{
+		ModulePath:      conf.modulePath,
+		LocalPrefixes:   conf.localPrefixes,
+		CompanyPrefixes: conf.companyPrefixes,
+		cache:           cache,
 	}
 
-	err = format.Node(w, fs, f)
-	if err != nil {
-		return err
+	if conf.fix {
+		names := newImportNameResolver(conf.fixDir, ctx)
+		used := usedIdents(f)
+		is = dropUnusedImports(is, used, names)
+
+		added, err := resolveImports(conf.fixDir, missingIdents(used, is, names), ctx)
+		if err != nil {
+			return fmt.Errorf("failed to resolve imports: %w", err)
+		}
+		is = append(is, added...)
 	}
 
-	return nil
-}
+	block := importBlock{cgo, conf.formatFunc(ctx, is)}
+	if block.empty() {
+		return format.Node(dst, fs, f)
+	}
 
-type importInsertWriter struct {
-	w          io.Writer
-	lineInsert int
-	count      int
-	buf        []byte
-	imports    GroupedImports
+	return insertImportBlock(dst, fs, f, insertPos, block)
 }
 
-func (w *importInsertWriter) Write(bs []byte) (int, error) {
-	if w.count >= w.lineInsert {
-		return w.w.Write(bs)
+// insertImportBlock prints f with block spliced in at insertPos. Rather than
+// counting output lines against a position captured from the pre-edit source
+// (fragile: deleting multi-line cgo preambles or whole import decls changes
+// how many lines the printer actually emits for what's left), it inserts a
+// sentinel single-spec import decl at insertPos so go/printer positions it
+// exactly the way it would the real thing — build tags, generated-file
+// headers and blank-line spacing included — then swaps the sentinel's
+// rendered line for block's real content.
+func insertImportBlock(dst io.Writer, fs *token.FileSet, f *ast.File, insertPos token.Pos, block importBlock) error {
+	marker := &ast.GenDecl{
+		TokPos: insertPos,
+		Tok:    token.IMPORT,
+		Specs: []ast.Spec{
+			&ast.ImportSpec{
+				Path: &ast.BasicLit{ValuePos: insertPos, Kind: token.STRING, Value: strconv.Quote(importMarkerPath)},
+			},
+		},
+	}
+	f.Decls = append([]ast.Decl{marker}, f.Decls...)
+
+	var printed bytes.Buffer
+	if err := format.Node(&printed, fs, f); err != nil {
+		return err
 	}
 
-	w.count += bytes.Count(bs, []byte{'\n'})
-	w.buf = append(w.buf, bs...)
-
-	if w.count < w.lineInsert {
-		return len(bs), nil
+	markerLine := "import " + strconv.Quote(importMarkerPath) + "\n"
+	if !strings.Contains(printed.String(), markerLine) {
+		return errors.New("failed to locate import insertion point")
 	}
 
-	var (
-		count int
-		idx   int
-	)
-	for idx = 0; idx < len(w.buf); idx++ {
-		if w.buf[idx] != '\n' {
-			continue
-		}
-		count++
-		if count+1 >= w.lineInsert {
-			idx++
-			break
-		}
+	var rendered bytes.Buffer
+	if _, err := block.WriteTo(&rendered); err != nil {
+		return err
 	}
 
-	var written int
-	n, err := w.w.Write(w.buf[:idx])
-	if err != nil {
-		return 0, err
-	}
-	written += n
+	_, err := io.WriteString(dst, strings.Replace(printed.String(), markerLine, rendered.String(), 1))
+	return err
+}
 
-	n64, err := w.imports.WriteTo(w.w)
+// importMarkerPath can't collide with a real import path: Go import paths
+// can't contain NUL bytes.
+const importMarkerPath = "\x00goimportfmt-import-marker\x00"
+
+// Check reports whether Process would produce output different from src,
+// without the caller having to diff the result themselves. For a file with
+// no import declarations and no fix pass enabled, Process only gofmts the
+// source, so that case is answered with go/format alone, without running
+// the import pipeline.
+func Check(src io.Reader, opts ...Option) (bool, error) {
+	original, err := ioutil.ReadAll(src)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	written += int(n64)
 
-	n, err = w.w.Write([]byte{'\n'})
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, "", original, parser.ImportsOnly)
 	if err != nil {
-		return 0, err
+		return false, fmt.Errorf("failed to parse file: %w", err)
+	}
+	if !hasImports(f) && !newConfig(opts).fix {
+		formatted, err := format.Source(original)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse file: %w", err)
+		}
+		return !bytes.Equal(original, formatted), nil
 	}
-	written += n
 
-	n, err = w.w.Write(w.buf[idx:])
-	if err != nil {
-		return 0, err
+	var out bytes.Buffer
+	if err := Process(bytes.NewReader(original), &out, opts...); err != nil {
+		return false, err
 	}
-	written += n
 
-	w.buf = nil // to GC
+	return !bytes.Equal(original, out.Bytes()), nil
+}
 
-	return written, nil
+func hasImports(f *ast.File) bool {
+	for _, d := range f.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			return true
+		}
+	}
+	return false
 }
 
 type Option func(*config)
 
 type config struct {
-	modulePath string
-	formatFunc FormatFunc
+	modulePath      string
+	localPrefixes   []string
+	companyPrefixes []string
+	formatFunc      FormatFunc
+	ctx             *Context
+	fix             bool
+	fixDir          string
 }
 
 func WithModulePath(path string) Option {
@@ -134,6 +181,66 @@ func WithModulePath(path string) Option {
 	}
 }
 
+// WithContext makes Process share the given Context's cache, so that state
+// cached on it (such as the stdlib set used by Context.IsStdlib) survives
+// across a batch of Process calls. Process still builds its own Context for
+// the per-call fields: ModulePath, LocalPrefixes and CompanyPrefixes set on
+// ctx are ignored in favour of the configured Options.
+func WithContext(ctx *Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// WithFix enables a goimports-style fix pass: unused imports are dropped and
+// identifiers that aren't satisfied by any declared import are resolved to
+// new imports, before the result is handed to the configured FormatFunc.
+// Resolving new imports requires the source directory, set via WithSourceDir;
+// without it only the drop-unused half of the pass runs.
+func WithFix(enable bool) Option {
+	return func(c *config) {
+		c.fix = enable
+	}
+}
+
+// WithSourceDir tells the fix pass enabled by WithFix which directory to
+// scope package resolution to (current module, GOPATH and module cache).
+func WithSourceDir(dir string) Option {
+	return func(c *config) {
+		c.fixDir = dir
+	}
+}
+
+// WithLocalPrefixes adds package prefixes that should be grouped together
+// with the current module, e.g. other modules in the same monorepo. Each
+// argument may be a comma-joined list, mirroring goimports' -local flag.
+func WithLocalPrefixes(prefixes ...string) Option {
+	return func(c *config) {
+		c.localPrefixes = append(c.localPrefixes, splitPrefixes(prefixes)...)
+	}
+}
+
+// WithCompanyPrefixes adds package prefixes that should be grouped between
+// third-party and local imports, e.g. a company's internal packages.
+func WithCompanyPrefixes(prefixes ...string) Option {
+	return func(c *config) {
+		c.companyPrefixes = append(c.companyPrefixes, splitPrefixes(prefixes)...)
+	}
+}
+
+func splitPrefixes(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		for _, p := range strings.Split(arg, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
 func newConfig(opts []Option) *config {
 	c := &config{
 		formatFunc: defaultFormatFunc,
@@ -144,15 +251,40 @@ func newConfig(opts []Option) *config {
 	return c
 }
 
+// matchesPrefix reports whether pkg is prefix itself or a sub-package of
+// prefix, so that e.g. "github.com/acme" matches "github.com/acme/foo" but
+// not "github.com/acmecorp".
+func matchesPrefix(pkg, prefix string) bool {
+	if pkg == prefix {
+		return true
+	}
+	return strings.HasPrefix(pkg, prefix+"/")
+}
+
+func matchesAnyPrefix(pkg string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if matchesPrefix(pkg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func defaultFormatFunc(ctx *Context, is []*Import) GroupedImports {
 	groupOfImport := func(pkg string) int {
-		if ctx.ModulePath != "" && strings.HasPrefix(pkg, ctx.ModulePath) {
+		if ctx.ModulePath != "" && matchesPrefix(pkg, ctx.ModulePath) {
+			return 3
+		}
+		if matchesAnyPrefix(pkg, ctx.LocalPrefixes) {
+			return 3
+		}
+		if matchesAnyPrefix(pkg, ctx.CompanyPrefixes) {
 			return 2
 		}
-		if strings.Contains(pkg, ".") {
-			return 1
+		if ctx.IsStdlib(pkg) {
+			return 0
 		}
-		return 0
+		return 1
 	}
 
 	gi := make(GroupedImports)
@@ -184,11 +316,27 @@ func DetectModulePath(file string) (string, error) {
 		return "", errors.New("could not get absolute path")
 	}
 
+	return detectModulePath(dir, file)
+}
+
+// DetectModulePathDir is like DetectModulePath but takes the directory a
+// file would live in directly, for callers that have no real file to stat,
+// such as tooling that formats stdin.
+func DetectModulePathDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.New("could not get absolute path")
+	}
+
+	return detectModulePath(dir, ".")
+}
+
+func detectModulePath(dir, pattern string) (string, error) {
 	cfg := &packages.Config{
 		Dir:  dir,
 		Mode: packages.NeedModule,
 	}
-	pkgs, err := packages.Load(cfg, file)
+	pkgs, err := packages.Load(cfg, pattern)
 	if err != nil {
 		return "", fmt.Errorf("failed to load package: %w", err)
 	}
@@ -226,6 +374,47 @@ func DetectModulePath(file string) (string, error) {
 	return pkg.Module.Path, nil
 }
 
+func loadImportsFromFile(file string) ([]*Import, error) {
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, file, nil, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	return loadImports(f)
+}
+
+// buildConstraintRE matches //go:build and // +build lines, generatedHeaderRE
+// matches the "Code generated ... DO NOT EDIT." marker. Comment groups that
+// match either are anchors: they belong to the file, not to whichever decl
+// happens to sit closest below them, so loadImports and removeImports leave
+// them alone instead of folding them into an import's doc comment.
+var (
+	buildConstraintRE = regexp.MustCompile(`^(//go:build|// \+build)`)
+	generatedHeaderRE = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+)
+
+func isAnchorComment(cg *ast.CommentGroup) bool {
+	if cg == nil || len(cg.List) == 0 {
+		return false
+	}
+	text := cg.List[0].Text
+	return buildConstraintRE.MatchString(text) || generatedHeaderRE.MatchString(text)
+}
+
+// rawCommentText joins a comment group's original tokens (including their
+// "//" or "/* */" markers) verbatim, for comments that must round-trip
+// exactly, such as a cgo preamble.
+func rawCommentText(cg *ast.CommentGroup) string {
+	if cg == nil {
+		return ""
+	}
+	lines := make([]string, len(cg.List))
+	for i, c := range cg.List {
+		lines[i] = c.Text
+	}
+	return strings.Join(lines, "\n")
+}
+
 func loadImports(f *ast.File) ([]*Import, error) {
 	var imports []*Import
 	for _, d := range f.Decls {
@@ -238,7 +427,7 @@ func loadImports(f *ast.File) ([]*Import, error) {
 		}
 
 		var docs []string
-		if gd.Doc != nil {
+		if gd.Doc != nil && !isAnchorComment(gd.Doc) {
 			for _, c := range gd.Doc.List {
 				docs = append(docs, strings.TrimSpace(strings.TrimPrefix(c.Text, "//")))
 			}
@@ -246,16 +435,34 @@ func loadImports(f *ast.File) ([]*Import, error) {
 
 		var isNotFirst bool
 		for _, s := range gd.Specs {
-			if isNotFirst {
-				docs = nil
-			}
-			isNotFirst = true
 			is := s.(*ast.ImportSpec)
 
 			path, err := strconv.Unquote(is.Path.Value)
 			if err != nil {
 				path = is.Path.Value
 			}
+
+			if path == "C" {
+				impt := &Import{Path: path, Cgo: true}
+				doc := is.Doc
+				if doc == nil && !isNotFirst {
+					doc = gd.Doc
+				}
+				if !isAnchorComment(doc) {
+					impt.RawDoc = rawCommentText(doc)
+				}
+				impt.RawComment = rawCommentText(is.Comment)
+				imports = append(imports, impt)
+				isNotFirst = true
+				docs = nil
+				continue
+			}
+
+			if isNotFirst {
+				docs = nil
+			}
+			isNotFirst = true
+
 			impt := &Import{
 				Path: path,
 				Docs: docs,
@@ -286,6 +493,97 @@ type Import struct {
 	Path    string
 	Docs    []string
 	Comment string
+
+	// Cgo marks the import "C" pseudo-package. Go requires it to be a
+	// standalone import declaration, so it never takes part in
+	// GroupedImports and is rendered by importBlock instead.
+	Cgo bool
+	// RawDoc and RawComment hold the cgo import's original comment text
+	// verbatim (including the "//" or "/* */" markers), since a cgo
+	// preamble is often a multi-line /* ... */ block that can't round-trip
+	// through the per-line Docs format used for regular imports.
+	RawDoc     string
+	RawComment string
+}
+
+// extractCgoImport pulls the "C" pseudo-import, if any, out of is so it can
+// be rendered as its own import "C" statement instead of inside the grouped
+// import (...) block, which Go doesn't allow for cgo.
+func extractCgoImport(is []*Import) (cgo *Import, rest []*Import) {
+	rest = is[:0:0]
+	for _, i := range is {
+		if i.Cgo {
+			cgo = i
+			continue
+		}
+		rest = append(rest, i)
+	}
+	return cgo, rest
+}
+
+// importBlock renders the optional cgo import "C" statement followed by the
+// regular grouped import (...) block.
+type importBlock struct {
+	cgo *Import
+	gi  GroupedImports
+}
+
+func (b importBlock) empty() bool {
+	return b.cgo == nil && len(b.gi) == 0
+}
+
+func (b importBlock) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+
+	if b.cgo != nil {
+		n, err := writeCgoImport(w, b.cgo)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if len(b.gi) > 0 {
+			nn, err := fmt.Fprintln(w)
+			written += int64(nn)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	n, err := b.gi.WriteTo(w)
+	written += n
+	return written, err
+}
+
+func writeCgoImport(w io.Writer, i *Import) (int64, error) {
+	var written int64
+
+	if i.RawDoc != "" {
+		n, err := fmt.Fprintln(w, i.RawDoc)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	n, err := fmt.Fprint(w, `import "C"`)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	if i.RawComment != "" {
+		n, err = fmt.Fprintf(w, " %s", i.RawComment)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	n, err = fmt.Fprintln(w)
+	written += int64(n)
+	return written, err
 }
 
 type GroupedImports map[int][]*Import
@@ -381,11 +679,122 @@ func (gp GroupedImports) WriteTo(w io.Writer) (written int64, _ error) {
 
 type FormatFunc func(*Context, []*Import) GroupedImports
 
+// Context holds both per-call settings (ModulePath, LocalPrefixes,
+// CompanyPrefixes, all set fresh by Process on every call from the
+// configured Options) and a pointer to state that's safe, and worth,
+// sharing across a batch of Process calls via WithContext: package
+// metadata that doesn't depend on which file is being formatted. The two
+// are split apart so that sharing a Context across concurrent Process
+// calls (e.g. one per file in a worker pool) never races: each call gets
+// its own Context value for the per-call fields, pointing at the same
+// cache.
 type Context struct {
-	ModulePath string
+	ModulePath      string
+	LocalPrefixes   []string
+	CompanyPrefixes []string
+
+	cacheOnce sync.Once
+	cache     *contextCache
+}
+
+// contextCache is the part of a Context that Process reuses across calls
+// instead of recomputing: the standard library set (chunk0-2), and the
+// resolved-import-name and sibling-import lookups the fix pass does
+// (chunk0-3). All of it is read and written from concurrent Process calls
+// when a Context is shared via WithContext, hence the locking.
+type contextCache struct {
+	stdlibOnce sync.Once
+	stdlibSet  map[string]bool
+	stdlibOK   bool
+
+	mu       sync.Mutex
+	names    map[string]string
+	siblings map[string]map[string]bool
+}
+
+// ensureCache returns ctx's cache, allocating it on first use so a
+// zero-value Context (e.g. one built with WithContext(&Context{})) works
+// without the caller having to construct the cache explicitly.
+func (ctx *Context) ensureCache() *contextCache {
+	ctx.cacheOnce.Do(func() {
+		if ctx.cache == nil {
+			ctx.cache = &contextCache{}
+		}
+	})
+	return ctx.cache
 }
 
-func removeImports(fs *token.FileSet, f *ast.File) (firstImportLine int, _ error) {
+// IsStdlib reports whether path is a standard library package. The stdlib
+// set is loaded from `go list std` on first use and cached on ctx, so it is
+// computed at most once per Context even across many Process calls (share a
+// Context via WithContext to reuse it across a batch of files). If loading
+// fails, e.g. no Go toolchain is available, it falls back to the old
+// heuristic of treating any path without a dot as stdlib.
+func (ctx *Context) IsStdlib(path string) bool {
+	c := ctx.ensureCache()
+	c.stdlibOnce.Do(c.loadStdlib)
+	if c.stdlibOK {
+		return c.stdlibSet[path]
+	}
+	return !strings.Contains(path, ".")
+}
+
+func (c *contextCache) loadStdlib() {
+	pkgs, err := packages.Load(nil, "std")
+	if err != nil {
+		return
+	}
+
+	set := make(map[string]bool, len(pkgs))
+	for _, p := range pkgs {
+		set[p.PkgPath] = true
+	}
+	c.stdlibSet = set
+	c.stdlibOK = true
+}
+
+// cachedName returns the import name previously cached for path by
+// cacheName, if any.
+func (c *contextCache) cachedName(path string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.names[path]
+	return name, ok
+}
+
+func (c *contextCache) cacheName(path, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil {
+		c.names = make(map[string]string)
+	}
+	c.names[path] = name
+}
+
+// cachedSiblings returns the sibling import set previously cached for dir
+// by cacheSiblings, if any.
+func (c *contextCache) cachedSiblings(dir string) (map[string]bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set, ok := c.siblings[dir]
+	return set, ok
+}
+
+func (c *contextCache) cacheSiblings(dir string, set map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.siblings == nil {
+		c.siblings = make(map[string]map[string]bool)
+	}
+	c.siblings[dir] = set
+}
+
+// removeImports strips every import decl from f and returns the position at
+// which a replacement import decl should be inserted: the first removed
+// decl's own position, preserving its place relative to build tags, the
+// package doc comment and any following decls, or the end of the package
+// clause if f had no imports at all.
+func removeImports(f *ast.File) (insertPos token.Pos, _ error) {
 	for i := 0; i < len(f.Decls); i++ {
 		d := f.Decls[i]
 
@@ -398,18 +807,18 @@ func removeImports(fs *token.FileSet, f *ast.File) (firstImportLine int, _ error
 			continue
 		}
 
-		if firstImportLine == 0 {
-			firstImportLine = fs.Position(gd.Pos()).Line
+		if insertPos == token.NoPos {
+			insertPos = gd.Pos()
 		}
 
 		var comments []*ast.CommentGroup
-		if gd.Doc != nil {
+		if gd.Doc != nil && !isAnchorComment(gd.Doc) {
 			comments = append(comments, gd.Doc)
 		}
 
 		for _, s := range gd.Specs {
 			is := s.(*ast.ImportSpec)
-			if is.Doc != nil {
+			if is.Doc != nil && !isAnchorComment(is.Doc) {
 				comments = append(comments, is.Doc)
 			}
 			if is.Comment != nil {
@@ -431,5 +840,9 @@ func removeImports(fs *token.FileSet, f *ast.File) (firstImportLine int, _ error
 		i--
 	}
 
-	return firstImportLine, nil
+	if insertPos == token.NoPos {
+		insertPos = f.Name.End()
+	}
+
+	return insertPos, nil
 }
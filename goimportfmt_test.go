@@ -0,0 +1,276 @@
+package goimportfmt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// process is a small helper around Process that fails the test on error and
+// returns the result as a string for easy comparison.
+func process(t *testing.T, src string, opts ...Option) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := Process(strings.NewReader(src), &out, opts...); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	return out.String()
+}
+
+func TestProcessPreservesBuildConstraint(t *testing.T) {
+	src := `//go:build linux
+// +build linux
+
+package foo
+
+import (
+	"fmt"
+)
+
+func F() { fmt.Println("x") }
+`
+
+	got := process(t, src)
+
+	if !strings.HasPrefix(got, "//go:build linux\n// +build linux\n") {
+		t.Fatalf("build constraint not preserved at top of file, got:\n%s", got)
+	}
+	if !strings.Contains(got, `"fmt"`) {
+		t.Fatalf("import dropped, got:\n%s", got)
+	}
+}
+
+func TestProcessPreservesGeneratedHeader(t *testing.T) {
+	src := `// Code generated by somegen. DO NOT EDIT.
+
+package foo
+
+import (
+	"fmt"
+)
+
+func F() { fmt.Println("x") }
+`
+
+	got := process(t, src)
+
+	if !strings.HasPrefix(got, "// Code generated by somegen. DO NOT EDIT.\n") {
+		t.Fatalf("generated header not preserved at top of file, got:\n%s", got)
+	}
+	if !strings.Contains(got, `"fmt"`) {
+		t.Fatalf("import dropped, got:\n%s", got)
+	}
+}
+
+func TestProcessRoundTripsCgoPreamble(t *testing.T) {
+	src := `package foo
+
+/*
+#include <stdio.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+)
+
+func F() { fmt.Println("x") }
+`
+
+	got := process(t, src)
+
+	if !strings.Contains(got, "#include <stdio.h>") || !strings.Contains(got, "#include <stdlib.h>") {
+		t.Fatalf("cgo preamble lost, got:\n%s", got)
+	}
+	if !strings.Contains(got, `import "C"`) {
+		t.Fatalf(`import "C" lost, got:\n%s`, got)
+	}
+	if !strings.Contains(got, `"fmt"`) {
+		t.Fatalf("regular import dropped, got:\n%s", got)
+	}
+}
+
+func TestProcessNoImportsIsUnchanged(t *testing.T) {
+	src := `package foo
+
+func F() {}
+`
+
+	got := process(t, src)
+
+	if got != src {
+		t.Fatalf("expected import-free file to round-trip unchanged, got:\n%s", got)
+	}
+}
+
+func TestMatchesPrefix(t *testing.T) {
+	cases := []struct {
+		pkg, prefix string
+		want        bool
+	}{
+		{"github.com/acme", "github.com/acme", true},
+		{"github.com/acme/foo", "github.com/acme", true},
+		{"github.com/acmecorp", "github.com/acme", false},
+		{"github.com/other", "github.com/acme", false},
+	}
+	for _, c := range cases {
+		if got := matchesPrefix(c.pkg, c.prefix); got != c.want {
+			t.Errorf("matchesPrefix(%q, %q) = %v, want %v", c.pkg, c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestDefaultFormatFuncGroupsByTier(t *testing.T) {
+	ctx := &Context{
+		ModulePath:      "example.com/myapp",
+		LocalPrefixes:   []string{"example.com/sibling"},
+		CompanyPrefixes: []string{"example.com/acme"},
+	}
+
+	is := []*Import{
+		{Path: "fmt"},
+		{Path: "github.com/pkg/errors"},
+		{Path: "example.com/acme/widgets"},
+		{Path: "example.com/sibling/util"},
+		{Path: "example.com/myapp/internal"},
+	}
+
+	gi := defaultFormatFunc(ctx, is)
+
+	groupOf := func(path string) (int, bool) {
+		for g, imps := range gi {
+			for _, i := range imps {
+				if i.Path == path {
+					return g, true
+				}
+			}
+		}
+		return 0, false
+	}
+
+	for path, want := range map[string]int{
+		"fmt":                        0,
+		"github.com/pkg/errors":      1,
+		"example.com/acme/widgets":   2,
+		"example.com/sibling/util":   3,
+		"example.com/myapp/internal": 3,
+	} {
+		got, ok := groupOf(path)
+		if !ok {
+			t.Errorf("%s: not present in any group", path)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: grouped into tier %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestIsStdlibFallsBackWhenStdlibUnavailable(t *testing.T) {
+	// Simulate `go list std` having failed (e.g. no Go toolchain) by marking
+	// the cache's stdlibOnce as already fired with stdlibOK left false,
+	// rather than actually breaking the toolchain out from under the test.
+	ctx := &Context{cache: &contextCache{}}
+	ctx.cache.stdlibOnce.Do(func() {})
+
+	if !ctx.IsStdlib("fmt") {
+		t.Error(`IsStdlib("fmt") = false, want true under the dot-free fallback heuristic`)
+	}
+	if ctx.IsStdlib("github.com/pkg/errors") {
+		t.Error(`IsStdlib("github.com/pkg/errors") = true, want false under the dot-free fallback heuristic`)
+	}
+}
+
+func TestContextCacheNameRoundTrips(t *testing.T) {
+	c := &contextCache{}
+
+	if _, ok := c.cachedName("github.com/go-redis/redis/v8"); ok {
+		t.Fatal("expected no cached name before cacheName is called")
+	}
+
+	c.cacheName("github.com/go-redis/redis/v8", "redis")
+
+	if name, ok := c.cachedName("github.com/go-redis/redis/v8"); !ok || name != "redis" {
+		t.Fatalf("cachedName = %q, %v, want %q, true", name, ok, "redis")
+	}
+}
+
+func TestContextCacheSiblingsRoundTrips(t *testing.T) {
+	c := &contextCache{}
+
+	if _, ok := c.cachedSiblings("/some/dir"); ok {
+		t.Fatal("expected no cached siblings before cacheSiblings is called")
+	}
+
+	want := map[string]bool{"fmt": true}
+	c.cacheSiblings("/some/dir", want)
+
+	got, ok := c.cachedSiblings("/some/dir")
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("cachedSiblings = %v, %v, want %v, true", got, ok, want)
+	}
+}
+
+func TestCheckReportsNoChangeForImportFreeFile(t *testing.T) {
+	src := `package foo
+
+func F() {}
+`
+
+	changed, err := Check(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if changed {
+		t.Fatal("Check reported a change for a file with no import declarations")
+	}
+}
+
+func TestCheckReportsChangeWhenGroupingDiffers(t *testing.T) {
+	src := `package foo
+
+import (
+	"github.com/pkg/errors"
+	"fmt"
+)
+
+func F() { fmt.Println(errors.New("x")) }
+`
+
+	changed, err := Check(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !changed {
+		t.Fatal("Check reported no change for a file with ungrouped stdlib/third-party imports")
+	}
+}
+
+func TestProcessFixAddsImportsToFileWithNoExistingImports(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/foo\n\ngo 1.18\n"), 0644); err != nil {
+		t.Fatalf("write go.mod: %v", err)
+	}
+	// packages.Load("all") only surfaces stdlib packages actually reachable
+	// from the module, so give it a sibling file that imports fmt.
+	sibling := "package foo\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n"
+	if err := os.WriteFile(filepath.Join(dir, "sibling.go"), []byte(sibling), 0644); err != nil {
+		t.Fatalf("write sibling.go: %v", err)
+	}
+
+	src := `package foo
+
+func F() string { return fmt.Sprintf("%d", 1) }
+`
+
+	got := process(t, src, WithFix(true), WithSourceDir(dir))
+
+	if !strings.Contains(got, `"fmt"`) {
+		t.Fatalf("WithFix did not add missing import to a file with no import block, got:\n%s", got)
+	}
+}